@@ -0,0 +1,7 @@
+//go:build amd64
+
+package ftrace
+
+// uprobeArgRegs are the SysV AMD64 ABI integer/pointer argument registers, in
+// calling-convention order, as ftrace's uprobe fetch-arg syntax names them.
+var uprobeArgRegs = []string{"di", "si", "dx", "cx", "r8", "r9"}
@@ -0,0 +1,7 @@
+//go:build arm64
+
+package ftrace
+
+// uprobeArgRegs are the AAPCS64 integer/pointer argument registers, in
+// calling-convention order, as ftrace's uprobe fetch-arg syntax names them.
+var uprobeArgRegs = []string{"x0", "x1", "x2", "x3", "x4", "x5"}
@@ -0,0 +1,9 @@
+//go:build !(amd64 || arm64)
+
+package ftrace
+
+// uprobeArgRegs is left empty on architectures we don't know the calling
+// convention's register names for, so a Uprobe still attaches but fetches no
+// arguments, rather than emitting register names that are wrong or simply
+// don't exist.
+var uprobeArgRegs []string
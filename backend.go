@@ -0,0 +1,20 @@
+package ftrace
+
+// ------------------------
+//   Perf event backend
+// ------------------------
+
+// Backend selects how a Probe ingests events from the kernel.
+type Backend int
+
+const (
+	// BackendText reads /sys/kernel/debug/tracing/trace_pipe as text lines.
+	// This is the default, always-available backend.
+	BackendText Backend = iota
+	// BackendPerf opens a perf_event_open ring buffer per CPU for the probe's
+	// tracepoint and decodes PERF_RECORD_SAMPLE records directly, instead of
+	// scanning trace_pipe. It requires CAP_PERFMON/CAP_SYS_ADMIN; Enable falls
+	// back to BackendText automatically if perf setup fails. Only available on
+	// linux; see perf_stub.go for other platforms.
+	BackendPerf
+)
@@ -0,0 +1,77 @@
+package ftrace
+
+import (
+	"debug/elf"
+	"fmt"
+)
+
+// ------------------------
+//   ELF symbol resolution
+// ------------------------
+
+// resolveSymbolOffset returns the file offset of symbol within binaryPath, as
+// required by the tracefs uprobe_events "binary:offset" descriptor syntax.
+// It falls back to the dynamic symbol table when the binary has no static
+// symbols (e.g. a stripped executable or shared library).
+func resolveSymbolOffset(binaryPath string, symbol string) (uint64, error) {
+	f, err := elf.Open(binaryPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	vaddr, err := findSymbolOffset(f, symbol)
+	if err != nil {
+		vaddr, err = findDynamicSymbolOffset(f, symbol)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return vaddrToFileOffset(f, vaddr)
+}
+
+//
+func findSymbolOffset(f *elf.File, symbol string) (uint64, error) {
+	symbols, err := f.Symbols()
+	if err != nil {
+		return 0, err
+	}
+	return symbolValue(symbols, symbol)
+}
+
+//
+func findDynamicSymbolOffset(f *elf.File, symbol string) (uint64, error) {
+	symbols, err := f.DynamicSymbols()
+	if err != nil {
+		return 0, err
+	}
+	return symbolValue(symbols, symbol)
+}
+
+//
+func symbolValue(symbols []elf.Symbol, symbol string) (uint64, error) {
+	for _, sym := range symbols {
+		if sym.Name == symbol {
+			return sym.Value, nil
+		}
+	}
+	return 0, fmt.Errorf("symbol %s not found", symbol)
+}
+
+// vaddrToFileOffset translates a symbol's virtual address into the file
+// offset uprobe_events actually expects, by finding the PT_LOAD segment that
+// maps it and subtracting that segment's own vaddr/file-offset skew. For a
+// PIE/shared object this skew is usually zero, but for a normal ET_EXEC
+// binary (e.g. linked at 0x400000) vaddr and file offset diverge.
+func vaddrToFileOffset(f *elf.File, vaddr uint64) (uint64, error) {
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD {
+			continue
+		}
+		if vaddr >= prog.Vaddr && vaddr < prog.Vaddr+prog.Filesz {
+			return vaddr - prog.Vaddr + prog.Off, nil
+		}
+	}
+	return 0, fmt.Errorf("address 0x%x is not mapped by any PT_LOAD segment", vaddr)
+}
@@ -0,0 +1,98 @@
+package ftrace
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ------------------------
+//   Event
+// ------------------------
+
+// Event represents a single FTRACE event read from the trace pipe, or decoded
+// from a perf ring buffer sample under BackendPerf. Events from the perf
+// backend leave Task empty and Timestamp zero.
+type Event struct {
+	Task      string            // name of the task that triggered the event
+	PID       int               // pid of the task that triggered the event
+	CPU       int               // cpu the event was recorded on
+	Timestamp float64           // kernel timestamp, in seconds
+	Name      string            // probe or sub event name
+	Args      map[string]string // fetched arguments, keyed by name
+	Retval    string            // return value, kretprobe/uretprobe events only
+}
+
+// parseEvent parses a single raw line read from trace_pipe into an Event.
+//
+// A typical line looks like:
+//
+//	          bash-1234  [000] .... 12345.678901: myprobe: (sys_openat+0x0/0x20) arg0="file.txt"
+func parseEvent(line string) (Event, error) {
+	line = strings.TrimSpace(line)
+
+	cpuStart := strings.IndexRune(line, '[')
+	cpuEnd := strings.IndexRune(line, ']')
+	if cpuStart == -1 || cpuEnd == -1 || cpuEnd < cpuStart {
+		return Event{}, fmt.Errorf("malformed event line: %s", line)
+	}
+
+	taskPid := strings.TrimSpace(line[:cpuStart])
+	dashOffset := strings.LastIndex(taskPid, "-")
+	if dashOffset == -1 {
+		return Event{}, fmt.Errorf("malformed event line: %s", line)
+	}
+	task := taskPid[:dashOffset]
+	pid, err := strconv.Atoi(taskPid[dashOffset+1:])
+	if err != nil {
+		return Event{}, fmt.Errorf("malformed pid in event line: %s", line)
+	}
+
+	cpu, err := strconv.Atoi(strings.TrimSpace(line[cpuStart+1 : cpuEnd]))
+	if err != nil {
+		return Event{}, fmt.Errorf("malformed cpu in event line: %s", line)
+	}
+
+	// skip the flags field, e.g. "d.h3"
+	remainder := strings.TrimSpace(line[cpuEnd+1:])
+	_, offset := parseNext(remainder, ' ')
+	if offset == -1 {
+		return Event{}, fmt.Errorf("malformed event line: %s", line)
+	}
+	remainder = strings.TrimSpace(remainder[offset+1:])
+
+	tsStr, offset := parseNext(remainder, ':')
+	if offset == -1 {
+		return Event{}, fmt.Errorf("malformed timestamp in event line: %s", line)
+	}
+	ts, err := strconv.ParseFloat(strings.TrimSpace(tsStr), 64)
+	if err != nil {
+		return Event{}, fmt.Errorf("malformed timestamp in event line: %s", line)
+	}
+	remainder = strings.TrimSpace(remainder[offset+1:])
+
+	name, offset := parseNext(remainder, ':')
+	if offset == -1 {
+		name = remainder
+		remainder = ""
+	} else {
+		remainder = strings.TrimSpace(remainder[offset+1:])
+	}
+
+	args := make(map[string]string)
+	for _, tok := range strings.Fields(remainder) {
+		if eq := strings.IndexRune(tok, '='); eq != -1 {
+			args[tok[:eq]] = strings.Trim(tok[eq+1:], "\"")
+		}
+	}
+
+	return Event{
+		Task:      task,
+		PID:       pid,
+		CPU:       cpu,
+		Timestamp: ts,
+		Name:      strings.TrimSpace(name),
+		Args:      args,
+		Retval:    args["retval"],
+	}, nil
+}
@@ -0,0 +1,84 @@
+package ftrace
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ------------------------
+//   Filters
+// ------------------------
+
+// FilterSyntaxError is returned when the kernel rejects a filter expression
+// written to a tracefs filter file.
+type FilterSyntaxError struct {
+	Expr   string // the expression that was rejected
+	Reason string // the kernel's "# ERROR:" message
+}
+
+func (e *FilterSyntaxError) Error() string {
+	return fmt.Sprintf("invalid filter expression %q: %s", e.Expr, e.Reason)
+}
+
+// SetFilter installs a kernel-side filter expression on this probe's own
+// event, e.g. `common_pid == 1234 && arg0 == "root"`. The expression is
+// passed through to the kernel as-is; if the kernel rejects it, SetFilter
+// returns a *FilterSyntaxError.
+func (p *Probe) SetFilter(expr string) error {
+	path := fmt.Sprintf(probeFilterFormat, p.kind.group(), p.name)
+	return writeFilterExpr(path, expr)
+}
+
+// SetEventFilter installs a kernel-side filter expression on one of this
+// probe's sub events.
+func (p *Probe) SetEventFilter(eventName string, expr string) error {
+	se, ok := p.events[eventName]
+	if !ok {
+		return fmt.Errorf("unknown sub event %s", eventName)
+	}
+	return writeFilterExpr(se.filterFile, expr)
+}
+
+// clearFilters resets the probe's own filter and all of its sub events'
+// filters back to unfiltered.
+func (p *Probe) clearFilters() error {
+	path := fmt.Sprintf(probeFilterFormat, p.kind.group(), p.name)
+	if err := writeFile(path, "0"); err != nil {
+		return fmt.Errorf("Error while clearing filter for probe %s: %s", p.name, err)
+	}
+
+	for eventName, se := range p.events {
+		if err := writeFile(se.filterFile, "0"); err != nil {
+			return fmt.Errorf("Error while clearing filter for event %s: %s", eventName, err)
+		}
+	}
+
+	return nil
+}
+
+//
+func writeFilterExpr(path string, expr string) error {
+	if err := writeFile(path, expr); err != nil {
+		return err
+	}
+
+	data, err := readFile(path)
+	if err != nil {
+		return err
+	}
+
+	if reason, bad := filterErrorReason(data); bad {
+		return &FilterSyntaxError{Expr: expr, Reason: reason}
+	}
+	return nil
+}
+
+//
+func filterErrorReason(data string) (string, bool) {
+	for _, line := range strings.Split(data, "\n") {
+		if strings.HasPrefix(line, "# ERROR:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "# ERROR:")), true
+		}
+	}
+	return "", false
+}
@@ -2,17 +2,26 @@ package ftrace
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // ------------------------
 //   File Reader
 // ------------------------
 
-func asyncFileReader(filename string) (chan string, error) {
+// readPollInterval bounds how long asyncFileReader can block in a single Read
+// before checking ctx for cancellation. trace_pipe never returns EOF on its
+// own, so this is what lets the reader goroutine wake up and exit promptly.
+const readPollInterval = 500 * time.Millisecond
+
+func asyncFileReader(ctx context.Context, filename string) (chan string, error) {
 	fp, err := os.Open(filename)
 	if err != nil {
 		return nil, err
@@ -24,16 +33,48 @@ func asyncFileReader(filename string) (chan string, error) {
 		// we need to close the out channel in order
 		// to signal the end-of-data condition
 		defer close(out)
-		scanner := bufio.NewScanner(fp)
+		scanner := bufio.NewScanner(&deadlineReader{ctx: ctx, fp: fp})
 		scanner.Split(bufio.ScanLines)
 		for scanner.Scan() {
-			out <- scanner.Text()
+			select {
+			case out <- scanner.Text():
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
 	return out, nil
 }
 
+// deadlineReader wraps a file with a rolling read deadline so Read wakes up
+// every readPollInterval to check ctx, instead of blocking forever on a file
+// like trace_pipe that never hits EOF.
+type deadlineReader struct {
+	ctx context.Context
+	fp  *os.File
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	for {
+		select {
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		default:
+		}
+
+		if err := r.fp.SetReadDeadline(time.Now().Add(readPollInterval)); err != nil {
+			return 0, err
+		}
+
+		n, err := r.fp.Read(p)
+		if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		return n, err
+	}
+}
+
 // ------------------------
 //   Library
 // ------------------------
@@ -57,11 +98,26 @@ func readFileOr(filename string, deflt string) string {
 	return string(data)
 }
 
+//
+func readFile(filename string) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
 //
 func writeFile(filename string, data string) error {
 	return ioutil.WriteFile(filename, []byte(data), 0755)
 }
 
+// isEexist returns true if err ultimately wraps syscall.EEXIST, e.g. because a
+// kprobe_events descriptor was already registered under the same name.
+func isEexist(err error) bool {
+	return errors.Is(err, syscall.EEXIST)
+}
+
 //
 func appendFile(filename string, data string) error {
 	fp, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0755)
@@ -78,18 +134,53 @@ func appendFile(filename string, data string) error {
 }
 
 //
-func makeDescriptor(name, syscall string) string {
-	d := fmt.Sprintf("p:kprobes/%s %s", name, syscall)
-	// command line args will be in %si, we're asking ftrace for them
-	for argn := 0; argn < maxArguments; argn++ {
-		d += fmt.Sprintf(" arg%d=+0(+%d(%%si)):string", argn, argn*8)
+func makeDescriptor(kind ProbeKind, name, target string, maxActive int) string {
+	letter := "p"
+	if kind.isReturn() {
+		letter = "r"
+		if maxActive > 0 {
+			letter = fmt.Sprintf("r%d", maxActive)
+		}
+	}
+
+	d := fmt.Sprintf("%s:%s/%s %s", letter, kind.group(), name, target)
+	d += argFetchExpr(kind)
+	if kind.isReturn() {
+		// the return value is only available on return probes
+		d += " retval=$retval"
+	}
+	return d
+}
+
+// argFetchExpr returns the space-prefixed arg fetch expressions appropriate
+// for kind.
+func argFetchExpr(kind ProbeKind) string {
+	var d string
+	switch kind {
+	case Uprobe:
+		// an arbitrary function's arguments are whatever the ABI put in
+		// these registers; fetch them plainly, with no :string cast and none
+		// of the argv double-dereference below, which only makes sense for a
+		// syscall entry point. uprobeArgRegs is arch-specific; see
+		// arch_regs_*.go.
+		for argn, reg := range uprobeArgRegs {
+			d += fmt.Sprintf(" arg%d=%%%s", argn, reg)
+		}
+	case Uretprobe:
+		// the argument registers have long since been clobbered by the time
+		// a uretprobe fires; only $retval below is meaningful here.
+	default:
+		// command line args will be in %si, we're asking ftrace for them
+		for argn := 0; argn < maxArguments; argn++ {
+			d += fmt.Sprintf(" arg%d=+0(+%d(%%si)):string", argn, argn*8)
+		}
 	}
 	return d
 }
 
 //
-func mapSubevents(subEvents []string) map[string]string {
-	m := make(map[string]string)
+func mapSubevents(subEvents []string) map[string]subEvent {
+	m := make(map[string]subEvent)
 	if subEvents != nil {
 		for _, eventName := range subEvents {
 			eventPath := eventName
@@ -98,7 +189,10 @@ func mapSubevents(subEvents []string) map[string]string {
 				parts := strings.SplitN(eventName, "/", 2)
 				eventName = parts[1]
 			}
-			m[eventName] = fmt.Sprintf(eventFileFormat, eventPath)
+			m[eventName] = subEvent{
+				enableFile: fmt.Sprintf(eventFileFormat, eventPath),
+				filterFile: fmt.Sprintf(eventFilterFormat, eventPath),
+			}
 		}
 	}
 	return m
@@ -0,0 +1,367 @@
+//go:build linux
+
+package ftrace
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ------------------------
+//   Perf event backend
+// ------------------------
+//
+// This file, and BackendPerf's actual implementation, is linux-only: it needs
+// perf_event_open(2) and an mmap'd ring buffer, neither of which exist outside
+// linux. See perf_stub.go for the stand-in used on other platforms.
+
+const (
+	tracepointIDFormat     = "/sys/kernel/debug/tracing/events/%s/%s/id"
+	tracepointFormatFormat = "/sys/kernel/debug/tracing/events/%s/%s/format"
+
+	perfTypeTracepoint  = 2 // PERF_TYPE_TRACEPOINT
+	perfSampleRaw       = 1 << 10
+	perfRecordSample    = 9
+	perfEventHeaderSize = 8 // perf_event_header: type(4) + misc(2) + size(2)
+
+	ringBufferDataPages = 8 // + 1 metadata page, must be a power of two
+	dataHeadOffset      = 1024
+	dataTailOffset      = 1032
+
+	perfPollInterval = time.Millisecond
+)
+
+// perfEventAttr mirrors struct perf_event_attr from linux/perf_event.h, field
+// for field, so its in-memory layout matches what the kernel expects.
+type perfEventAttr struct {
+	Type               uint32
+	Size               uint32
+	Config             uint64
+	SamplePeriod       uint64
+	SampleType         uint64
+	ReadFormat         uint64
+	Flags              uint64
+	WakeupEvents       uint32
+	BPType             uint32
+	BPAddr             uint64
+	BPLen              uint64
+	BranchSampleType   uint64
+	SampleRegsUser     uint64
+	SampleStackUser    uint32
+	ClockID            int32
+	SampleRegsIntr     uint64
+	AuxWatermark       uint32
+	SampleMaxStack     uint16
+	Reserved2          uint16
+	AuxSampleSize      uint32
+	Reserved3          uint32
+	SigData            uint64
+}
+
+// perfEventOpen is a thin wrapper around the perf_event_open(2) syscall.
+func perfEventOpen(attr *perfEventAttr, pid, cpu, groupFd int, flags uintptr) (int, error) {
+	if perfEventOpenSyscall == 0 {
+		return -1, fmt.Errorf("perf_event_open is not supported on this platform/architecture")
+	}
+
+	r1, _, errno := syscall.Syscall6(
+		perfEventOpenSyscall,
+		uintptr(unsafe.Pointer(attr)),
+		uintptr(pid),
+		uintptr(cpu),
+		uintptr(groupFd),
+		flags,
+		0,
+	)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r1), nil
+}
+
+//
+func tracepointID(kind ProbeKind, name string) (uint64, error) {
+	data, err := readFile(fmt.Sprintf(tracepointIDFormat, kind.group(), name))
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSpace(data), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed tracepoint id for %s: %s", name, err)
+	}
+	return id, nil
+}
+
+// formatField is one field of a tracepoint's /format file.
+type formatField struct {
+	name    string
+	offset  int
+	size    int
+	dataLoc bool // field is a __data_loc pointing at a variable-length blob
+}
+
+var formatFieldRegexp = regexp.MustCompile(`field:(.+?)\s+(\w+);\s*offset:(\d+);\s*size:(\d+);`)
+
+//
+func parseFormatFile(path string) ([]formatField, error) {
+	data, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []formatField
+	for _, line := range strings.Split(data, "\n") {
+		m := formatFieldRegexp.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+
+		offset, _ := strconv.Atoi(m[3])
+		size, _ := strconv.Atoi(m[4])
+		fields = append(fields, formatField{
+			name:    m[2],
+			offset:  offset,
+			size:    size,
+			dataLoc: strings.Contains(m[1], "__data_loc"),
+		})
+	}
+	return fields, nil
+}
+
+// perfBackend owns one ring buffer reader per CPU for a single probe.
+type perfBackend struct {
+	readers []*perfCPUReader
+	wg      sync.WaitGroup
+}
+
+// newPerfBackend opens a perf_event_open ring buffer on every CPU for the
+// given probe's tracepoint, and starts a goroutine per CPU that decodes
+// PERF_RECORD_SAMPLE records and hands them to p.emit.
+func newPerfBackend(ctx context.Context, kind ProbeKind, name string, p *Probe) (*perfBackend, error) {
+	id, err := tracepointID(kind, name)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := parseFormatFile(fmt.Sprintf(tracepointFormatFormat, kind.group(), name))
+	if err != nil {
+		return nil, err
+	}
+
+	b := &perfBackend{readers: make([]*perfCPUReader, 0, runtime.NumCPU())}
+	for cpu := 0; cpu < runtime.NumCPU(); cpu++ {
+		r, err := newPerfCPUReader(id, cpu)
+		if err != nil {
+			for _, opened := range b.readers {
+				opened.close()
+			}
+			return nil, fmt.Errorf("Error opening perf ring buffer for cpu %d: %s", cpu, err)
+		}
+		b.readers = append(b.readers, r)
+	}
+
+	for _, r := range b.readers {
+		b.wg.Add(1)
+		go r.run(ctx, &b.wg, name, fields, p)
+	}
+
+	return b, nil
+}
+
+// wait blocks until every per-CPU reader goroutine has exited, then releases
+// their ring buffers and file descriptors.
+func (b *perfBackend) wait() {
+	b.wg.Wait()
+	for _, r := range b.readers {
+		r.close()
+	}
+}
+
+// perfCPUReader is a single perf_event_open ring buffer, mmapped for one CPU.
+type perfCPUReader struct {
+	fd       int
+	cpu      int
+	data     []byte
+	pageSize int
+}
+
+//
+func newPerfCPUReader(id uint64, cpu int) (*perfCPUReader, error) {
+	attr := &perfEventAttr{
+		Type:         perfTypeTracepoint,
+		Config:       id,
+		SamplePeriod: 1,
+		SampleType:   perfSampleRaw,
+		WakeupEvents: 1,
+	}
+	attr.Size = uint32(unsafe.Sizeof(*attr))
+
+	fd, err := perfEventOpen(attr, -1, cpu, -1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("perf_event_open: %s", err)
+	}
+
+	pageSize := os.Getpagesize()
+	data, err := syscall.Mmap(fd, 0, pageSize*(1+ringBufferDataPages), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("mmap: %s", err)
+	}
+
+	return &perfCPUReader{fd: fd, cpu: cpu, data: data, pageSize: pageSize}, nil
+}
+
+//
+func (r *perfCPUReader) close() {
+	syscall.Munmap(r.data)
+	syscall.Close(r.fd)
+}
+
+// head returns the ring buffer's current write position, as published by the kernel.
+func (r *perfCPUReader) head() uint64 {
+	return atomic.LoadUint64((*uint64)(unsafe.Pointer(&r.data[dataHeadOffset])))
+}
+
+// setTail publishes our new read position back to the kernel.
+func (r *perfCPUReader) setTail(tail uint64) {
+	atomic.StoreUint64((*uint64)(unsafe.Pointer(&r.data[dataTailOffset])), tail)
+}
+
+// readRing copies n bytes starting at the (wrapping) ring position pos out of
+// the data area that follows the metadata page.
+func (r *perfCPUReader) readRing(pos uint64, n int) []byte {
+	ringSize := uint64(len(r.data) - r.pageSize)
+	off := int(pos % ringSize)
+
+	buf := make([]byte, n)
+	if off+n <= int(ringSize) {
+		copy(buf, r.data[r.pageSize+off:r.pageSize+off+n])
+	} else {
+		first := int(ringSize) - off
+		copy(buf[:first], r.data[r.pageSize+off:])
+		copy(buf[first:], r.data[r.pageSize:r.pageSize+(n-first)])
+	}
+	return buf
+}
+
+// run polls this CPU's ring buffer for PERF_RECORD_SAMPLE records until ctx
+// is cancelled, decoding each one and handing it to p.emit.
+func (r *perfCPUReader) run(ctx context.Context, wg *sync.WaitGroup, name string, fields []formatField, p *Probe) {
+	defer wg.Done()
+
+	var tail uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		head := r.head()
+		if tail == head {
+			time.Sleep(perfPollInterval)
+			continue
+		}
+
+		for tail != head {
+			hdr := r.readRing(tail, perfEventHeaderSize)
+			recType := binary.LittleEndian.Uint32(hdr[0:4])
+			recSize := binary.LittleEndian.Uint16(hdr[6:8])
+			if recSize < perfEventHeaderSize {
+				// malformed record; back off instead of busy-spinning and
+				// resync on the next head we observe
+				time.Sleep(perfPollInterval)
+				tail = head
+				break
+			}
+
+			if recType == perfRecordSample {
+				body := r.readRing(tail+perfEventHeaderSize, int(recSize)-perfEventHeaderSize)
+				event, err := decodeSample(name, fields, body, r.cpu)
+				if err != nil {
+					atomic.AddUint64(&p.parseErrors, 1)
+					p.logger.Errorf("Error while decoding perf sample: %s", err)
+				} else {
+					p.emit(event)
+				}
+			}
+
+			tail += uint64(recSize)
+		}
+
+		r.setTail(tail)
+	}
+}
+
+// decodeSample decodes a PERF_SAMPLE_RAW payload against the tracepoint's
+// format fields into an Event. cpu is the core the sample was read from, since
+// the raw payload itself carries no CPU number.
+func decodeSample(name string, fields []formatField, body []byte, cpu int) (Event, error) {
+	if len(body) < 4 {
+		return Event{}, fmt.Errorf("perf sample too short")
+	}
+
+	rawSize := int(binary.LittleEndian.Uint32(body[:4]))
+	if 4+rawSize > len(body) {
+		return Event{}, fmt.Errorf("perf sample raw size %d exceeds record", rawSize)
+	}
+	raw := body[4 : 4+rawSize]
+
+	args := make(map[string]string)
+	pid := 0
+	for _, f := range fields {
+		if f.offset+f.size > len(raw) {
+			continue
+		}
+		val := raw[f.offset : f.offset+f.size]
+
+		switch {
+		case f.name == "common_pid":
+			pid = int(int32(binary.LittleEndian.Uint32(val)))
+		case f.dataLoc:
+			loc := binary.LittleEndian.Uint32(val)
+			strOffset, strLen := int(loc&0xffff), int(loc>>16)
+			if strOffset+strLen <= len(raw) {
+				args[f.name] = strings.TrimRight(string(raw[strOffset:strOffset+strLen]), "\x00")
+			}
+		default:
+			args[f.name] = strconv.FormatUint(decodeUint(val), 10)
+		}
+	}
+
+	return Event{
+		PID:    pid,
+		CPU:    cpu,
+		Name:   name,
+		Args:   args,
+		Retval: args["retval"],
+	}, nil
+}
+
+//
+func decodeUint(val []byte) uint64 {
+	switch len(val) {
+	case 1:
+		return uint64(val[0])
+	case 2:
+		return uint64(binary.LittleEndian.Uint16(val))
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(val))
+	case 8:
+		return binary.LittleEndian.Uint64(val)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,6 @@
+//go:build linux && amd64
+
+package ftrace
+
+// perfEventOpenSyscall is __NR_perf_event_open, linux/amd64.
+const perfEventOpenSyscall uintptr = 298
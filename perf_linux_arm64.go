@@ -0,0 +1,6 @@
+//go:build linux && arm64
+
+package ftrace
+
+// perfEventOpenSyscall is __NR_perf_event_open, linux/arm64.
+const perfEventOpenSyscall uintptr = 241
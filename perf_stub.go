@@ -0,0 +1,22 @@
+//go:build !linux
+
+package ftrace
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+// perfBackend is a stand-in on platforms without perf_event_open(2) support;
+// newPerfBackend below never actually produces one. See perf.go for the real
+// linux implementation.
+type perfBackend struct{}
+
+// newPerfBackend always fails on non-linux platforms, so Enable falls back to
+// BackendText the same way it does for a linux perf_event_open failure.
+func newPerfBackend(ctx context.Context, kind ProbeKind, name string, p *Probe) (*perfBackend, error) {
+	return nil, fmt.Errorf("perf backend is not supported on GOOS=%s", runtime.GOOS)
+}
+
+func (b *perfBackend) wait() {}
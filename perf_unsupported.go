@@ -0,0 +1,11 @@
+//go:build linux && !(amd64 || arm64)
+
+package ftrace
+
+// perfEventOpenSyscall is left at its zero value on linux architectures we
+// don't know __NR_perf_event_open for. perfEventOpen refuses to issue the
+// syscall in that case, so the package still builds on every linux arch and
+// BackendPerf simply fails at runtime (Enable then falls back to BackendText)
+// instead of silently guessing a syscall number. Non-linux platforms use
+// perf_stub.go instead, which never references this constant.
+const perfEventOpenSyscall uintptr = 0
@@ -1,54 +1,198 @@
 package ftrace
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 const (
 	maxArguments      = 16
 	enabledStatusFile = "/proc/sys/kernel/ftrace_enabled"
-	systemProbesFile  = "/sys/kernel/debug/tracing/kprobe_events"
+	systemKprobesFile = "/sys/kernel/debug/tracing/kprobe_events"
+	systemUprobesFile = "/sys/kernel/debug/tracing/uprobe_events"
 	eventsPipeFile    = "/sys/kernel/debug/tracing/trace_pipe"
-	probeFileFormat   = "/sys/kernel/debug/tracing/events/kprobes/%s/enable"
+	probeFileFormat   = "/sys/kernel/debug/tracing/events/%s/%s/enable"
 	eventFileFormat   = "/sys/kernel/debug/tracing/events/%s/enable"
+	probeFilterFormat = "/sys/kernel/debug/tracing/events/%s/%s/filter"
+	eventFilterFormat = "/sys/kernel/debug/tracing/events/%s/filter"
 )
 
 var errUnavailable = errors.New("FTRACE kernel framework not available on your system")
 
+// errMaxActiveNotAllowed is returned when a non-zero maxActive is requested for a
+// probe kind other than Kretprobe/Uretprobe, since maxactive is a return-probe-only concept.
+var errMaxActiveNotAllowed = errors.New("maxactive is only valid for kretprobes and uretprobes")
+
+// ProbeKind identifies the flavour of FTRACE probe being created.
+type ProbeKind int
+
+const (
+	// Kprobe traces kernel function entry.
+	Kprobe ProbeKind = iota
+	// Kretprobe traces kernel function return, capturing the return value.
+	Kretprobe
+	// Uprobe traces user-space function entry.
+	Uprobe
+	// Uretprobe traces user-space function return, capturing the return value.
+	Uretprobe
+)
+
+// group returns the tracefs event group this probe kind is registered under.
+func (k ProbeKind) group() string {
+	switch k {
+	case Uprobe, Uretprobe:
+		return "uprobes"
+	default:
+		return "kprobes"
+	}
+}
+
+// isReturn returns true if this probe kind captures a function return.
+func (k ProbeKind) isReturn() bool {
+	return k == Kretprobe || k == Uretprobe
+}
+
+// systemProbesFile returns the tracefs control file new descriptors of this
+// probe kind are written to.
+func (k ProbeKind) systemProbesFile() string {
+	switch k {
+	case Uprobe, Uretprobe:
+		return systemUprobesFile
+	default:
+		return systemKprobesFile
+	}
+}
+
+// subEvent holds the tracefs control files for one of a probe's sub events.
+type subEvent struct {
+	enableFile string // .../events/<group>/<name>/enable
+	filterFile string // .../events/<group>/<name>/filter
+}
+
 // ------------------------
 //   Probe
 // ------------------------
 
-// Probe represents a FTRACE probe to a system call and optional sub events.
+// Probe represents a FTRACE probe to a kernel or user-space function and optional sub events.
 type Probe struct {
 	sync.RWMutex
-	name       string            // custom name of the probe
-	fileName   string            // probe status file name
-	syscall    string            // syscall to intercept
-	descriptor string            // ftrace descriptor of the probe
-	events     map[string]string // kernel sub events
-	enabled    bool              // probe status
-	pipe       chan string       // pipe file reader
-	done       chan bool         // channel used to signal from the worker
-	bus        chan Event        // channel where events are sent
+	name          string              // custom name of the probe
+	fileName      string              // probe status file name
+	target        string              // syscall name (kprobe) or "binary:0xoffset" (uprobe)
+	kind          ProbeKind           // kprobe/kretprobe/uprobe/uretprobe
+	maxActive     int                 // max concurrent instances, return probes only
+	prefix        string              // name prefix, NewProbeUnique only
+	unique        bool                // true if name collisions should be retried with a fresh suffix
+	descriptor    string              // ftrace descriptor of the probe
+	events        map[string]subEvent // kernel sub events
+	enabled       bool                // probe status
+	pipe          chan string         // pipe file reader
+	cancel        context.CancelFunc  // stops the pipe reader and worker goroutines
+	done          chan bool           // channel used to signal from the worker
+	bus           chan Event          // channel where events are sent
+	overflow      OverflowPolicy      // what to do when the bus is full
+	logger        Logger              // where parse errors are reported
+	eventsEmitted uint64              // cumulative count of events sent to bus, atomic
+	eventsDropped uint64              // cumulative count of events dropped by the overflow policy, atomic
+	parseErrors   uint64              // cumulative count of trace lines that failed to parse, atomic
+	backend       Backend             // how events are ingested from the kernel
+	perf          *perfBackend        // non-nil once a BackendPerf probe is enabled
+	busMu         sync.Mutex          // serializes emit's whole DropOldest path
 }
 
-// NewProbe creates a new probe with a custom name for the given syscall and optional sub events.
-func NewProbe(name string, syscall string, subEvents []string) *Probe {
+// newProbe builds a Probe of the given kind, validating that maxActive is only
+// used together with a return probe kind.
+func newProbe(kind ProbeKind, name string, target string, subEvents []string, maxActive int, opts Options) (*Probe, error) {
+	if !kind.isReturn() && maxActive != 0 {
+		return nil, errMaxActiveNotAllowed
+	}
+	opts = opts.withDefaults()
+
 	return &Probe{
 		name:       name,
-		fileName:   fmt.Sprintf(probeFileFormat, name),
-		syscall:    syscall,
-		descriptor: makeDescriptor(name, syscall),
+		fileName:   fmt.Sprintf(probeFileFormat, kind.group(), name),
+		target:     target,
+		kind:       kind,
+		maxActive:  maxActive,
+		descriptor: makeDescriptor(kind, name, target, maxActive),
 		events:     mapSubevents(subEvents),
 		enabled:    false,
 		pipe:       nil,
 		done:       make(chan bool),
-		bus:        make(chan Event),
+		bus:        make(chan Event, opts.BusSize),
+		overflow:   opts.Overflow,
+		logger:     opts.Logger,
+	}, nil
+}
+
+// NewProbe creates a new probe with a custom name for the given syscall and optional sub events.
+func NewProbe(name string, syscall string, subEvents []string) *Probe {
+	// maxActive is always 0 here, so the Kprobe/maxActive validation can never fail
+	p, _ := newProbe(Kprobe, name, syscall, subEvents, 0, Options{})
+	return p
+}
+
+// NewProbeWithOptions creates a new probe like NewProbe, but lets the caller
+// configure the event bus: its buffer size, the policy applied when the
+// buffer fills up, and where parse errors are reported. See Options.
+func NewProbeWithOptions(name string, syscall string, subEvents []string, opts Options) *Probe {
+	p, _ := newProbe(Kprobe, name, syscall, subEvents, 0, opts)
+	return p
+}
+
+// NewProbeWithBackend creates a new probe like NewProbe, but lets the caller
+// select how events are ingested from the kernel. See Backend.
+func NewProbeWithBackend(name string, syscall string, subEvents []string, backend Backend) *Probe {
+	p, _ := newProbe(Kprobe, name, syscall, subEvents, 0, Options{})
+	p.backend = backend
+	return p
+}
+
+// NewRetProbe creates a new kretprobe with a custom name for the given syscall and
+// optional sub events. maxActive bounds the number of concurrent instances of the
+// probed function that can be traced at once; 0 lets the kernel pick a default.
+func NewRetProbe(name string, syscall string, subEvents []string, maxActive int) (*Probe, error) {
+	return newProbe(Kretprobe, name, syscall, subEvents, maxActive, Options{})
+}
+
+// NewUprobe creates a new probe with a custom name attached to a symbol in a
+// user-space binary. offset is added to the symbol's resolved address, which
+// lets callers target a specific instruction inside the function. Events
+// carry the function's first 6 integer/pointer argument registers of the
+// platform ABI as arg0..arg5 (raw register values, not decoded as strings);
+// see arch_regs_*.go. On architectures other than amd64 and arm64 no
+// arguments are fetched.
+func NewUprobe(name string, binaryPath string, symbol string, offset uint64, subEvents []string) (*Probe, error) {
+	symOffset, err := resolveSymbolOffset(binaryPath, symbol)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving symbol %s in %s: %s", symbol, binaryPath, err)
 	}
+
+	target := fmt.Sprintf("%s:0x%x", binaryPath, symOffset+offset)
+	p, err := newProbe(Uprobe, name, target, subEvents, 0, Options{})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// NewUretprobe creates a new uretprobe attached to a symbol in a user-space
+// binary, mirroring NewUprobe but capturing the function's return value.
+// maxActive bounds the number of concurrent instances that can be traced at
+// once; 0 lets the kernel pick a default. Unlike NewUprobe, events carry only
+// Retval: the argument registers are long gone by the time a function returns.
+func NewUretprobe(name string, binaryPath string, symbol string, offset uint64, subEvents []string, maxActive int) (*Probe, error) {
+	symOffset, err := resolveSymbolOffset(binaryPath, symbol)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving symbol %s in %s: %s", symbol, binaryPath, err)
+	}
+
+	target := fmt.Sprintf("%s:0x%x", binaryPath, symOffset+offset)
+	return newProbe(Uretprobe, name, target, subEvents, maxActive, Options{})
 }
 
 // Enabled return true if this probe is enabled and running, otherwise false.
@@ -79,31 +223,48 @@ func (p *Probe) selectEvent(event string) bool {
 
 //
 func (p *Probe) worker() {
-	// signal we're done when we exit
+	// signal we're done when we exit; the range below ends once Disable
+	// cancels the probe's context and the reader goroutine closes p.pipe
 	defer func() {
 		p.done <- true
 	}()
 
 	for eventLine := range p.pipe {
-		// our parent go routine is telling us to quit
-		if eventLine == "<quit>" {
-			break
-		}
-
 		// check if we're interested in this event
 		if p.selectEvent(eventLine) {
 			// parse the raw event data
-			if event, err := parseEvent(eventLine); err != nil {
-				fmt.Printf("Error while parsing event: %s\n", err)
-			} else {
-				p.bus <- event
+			event, err := parseEvent(eventLine)
+			if err != nil {
+				atomic.AddUint64(&p.parseErrors, 1)
+				p.logger.Errorf("Error while parsing event: %s", err)
+				continue
 			}
+			p.emit(event)
+		}
+	}
+}
+
+// writeDescriptor registers p.descriptor in the kernel. If this is a
+// NewProbeUnique probe and the kernel rejects it with EEXIST (e.g. a leftover
+// probe from a previous crashed run still holds the name), it regenerates the
+// random suffix and retries up to maxUniqueRetries times.
+func (p *Probe) writeDescriptor() error {
+	err := writeFile(p.kind.systemProbesFile(), p.descriptor)
+
+	for attempt := 0; p.unique && isEexist(err) && attempt < maxUniqueRetries; attempt++ {
+		if err = p.regenerate(); err != nil {
+			return err
 		}
+		err = writeFile(p.kind.systemProbesFile(), p.descriptor)
 	}
+
+	return err
 }
 
 // Enable enables this probe and starts its async worker routine in order to read FTRACE events.
-func (p *Probe) Enable() (err error) {
+// The worker and its trace_pipe reader run for as long as ctx is not cancelled; Disable cancels
+// a context derived from ctx, so callers don't need to cancel ctx themselves.
+func (p *Probe) Enable(ctx context.Context) (err error) {
 	p.Lock()
 	defer p.Unlock()
 
@@ -116,14 +277,14 @@ func (p *Probe) Enable() (err error) {
 	}
 
 	// enable all events
-	for eventName, eventFileName := range p.events {
-		if err = writeFile(eventFileName, "1"); err != nil {
+	for eventName, se := range p.events {
+		if err = writeFile(se.enableFile, "1"); err != nil {
 			return fmt.Errorf("Error while enabling event %s: %s", eventName, err)
 		}
 	}
 
-	// create the custom kprobe consumer
-	if err = writeFile(systemProbesFile, p.descriptor); err != nil {
+	// create the custom probe consumer
+	if err = p.writeDescriptor(); err != nil {
 		return fmt.Errorf("Error while enabling probe descriptor for %s: %s", p.name, err)
 	}
 
@@ -132,8 +293,24 @@ func (p *Probe) Enable() (err error) {
 		return fmt.Errorf("Error while enable probe %s: %s", p.name, err)
 	}
 
+	// tied to a context we control so Disable can stop the reader goroutines
+	// even though trace_pipe never hits EOF
+	workerCtx, cancel := context.WithCancel(ctx)
+	p.cancel = cancel
+
+	if p.backend == BackendPerf {
+		if p.perf, err = newPerfBackend(workerCtx, p.kind, p.name, p); err != nil {
+			p.logger.Errorf("Error starting perf backend for %s, falling back to trace_pipe: %s", p.name, err)
+			p.backend = BackendText
+		} else {
+			p.enabled = true
+			return nil
+		}
+	}
+
 	// create the handle to the pipe file
-	if p.pipe, err = asyncFileReader(eventsPipeFile); err != nil {
+	if p.pipe, err = asyncFileReader(workerCtx, eventsPipeFile); err != nil {
+		cancel()
 		return fmt.Errorf("Error while opening %s: %s", eventsPipeFile, err)
 	}
 
@@ -149,8 +326,8 @@ func (p *Probe) Enable() (err error) {
 // Reset disables this probe.
 func (p *Probe) Reset() error {
 	// disable all events
-	for eventName, eventFileName := range p.events {
-		if err := writeFile(eventFileName, "0"); err != nil {
+	for eventName, se := range p.events {
+		if err := writeFile(se.enableFile, "0"); err != nil {
 			return fmt.Errorf("Error while disabling event %s: %s", eventName, err)
 		}
 	}
@@ -160,8 +337,13 @@ func (p *Probe) Reset() error {
 		return fmt.Errorf("Error while disabling probe %s: %s", p.name, err)
 	}
 
+	// clear any filter installed on the probe and its sub events
+	if err := p.clearFilters(); err != nil {
+		return err
+	}
+
 	// remove the probe from the system
-	if err := appendFile(systemProbesFile, fmt.Sprintf("-:%s", p.name)); err != nil {
+	if err := appendFile(p.kind.systemProbesFile(), fmt.Sprintf("-:%s", p.name)); err != nil {
 		return fmt.Errorf("Error while removing the probe %s: %s", p.name, err)
 	}
 
@@ -182,10 +364,16 @@ func (p *Probe) Disable() error {
 	}
 
 	p.enabled = false
-	p.pipe <- "<quit>"
-
-	// wait for the worker to finish
-	<-p.done
+	p.cancel()
+
+	if p.perf != nil {
+		// wait for every per-CPU ring buffer reader to finish
+		p.perf.wait()
+		p.perf = nil
+	} else {
+		// wait for the trace_pipe worker to finish
+		<-p.done
+	}
 
 	return nil
 }
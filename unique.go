@@ -0,0 +1,119 @@
+package ftrace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// maxProbeNameLength is the kernel's MAX_EVENT_NAME_LEN limit on a kprobe
+	// group/name pair.
+	maxProbeNameLength = 63
+	// maxUniqueRetries bounds how many times Enable will regenerate the
+	// random suffix of a NewProbeUnique probe after an EEXIST collision.
+	maxUniqueRetries = 5
+)
+
+// NewProbeUnique creates a new kprobe whose name is prefix followed by a random
+// 8-byte hex suffix, so that multiple instances of a program (or a previous
+// crashed run that left its probe registered) don't collide on the same
+// kprobe_events entry. If Enable hits an EEXIST on the generated name, it
+// transparently regenerates the suffix and retries.
+func NewProbeUnique(prefix string, syscall string, subEvents []string) (*Probe, error) {
+	name, err := uniqueProbeName(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := newProbe(Kprobe, name, syscall, subEvents, 0, Options{})
+	if err != nil {
+		return nil, err
+	}
+	p.prefix = prefix
+	p.unique = true
+	return p, nil
+}
+
+//
+func uniqueProbeName(prefix string) (string, error) {
+	suffix, err := randomSuffix()
+	if err != nil {
+		return "", err
+	}
+
+	name := prefix + "_" + suffix
+	if len(name) > maxProbeNameLength {
+		return "", fmt.Errorf("probe name %q exceeds the kernel's %d character limit", name, maxProbeNameLength)
+	}
+	return name, nil
+}
+
+//
+func randomSuffix() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	// hex.EncodeToString only ever emits [0-9a-f], which already satisfies
+	// the kernel's alphanumeric/underscore requirement for event names
+	return hex.EncodeToString(buf), nil
+}
+
+// regenerate picks a fresh random suffix for a NewProbeUnique probe and
+// rebuilds its fileName/descriptor to match, so Enable can retry after an
+// EEXIST collision.
+func (p *Probe) regenerate() error {
+	name, err := uniqueProbeName(p.prefix)
+	if err != nil {
+		return err
+	}
+
+	p.name = name
+	p.fileName = fmt.Sprintf(probeFileFormat, p.kind.group(), name)
+	p.descriptor = makeDescriptor(p.kind, name, p.target, p.maxActive)
+	return nil
+}
+
+// CleanupStaleProbes scans kprobe_events and removes any entry whose name
+// starts with prefix. This is meant to be called on startup to recover from
+// a previous run that crashed before it could Disable its NewProbeUnique
+// probes.
+func CleanupStaleProbes(prefix string) error {
+	data, err := readFile(systemKprobesFile)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		name := staleProbeName(line, prefix)
+		if name == "" {
+			continue
+		}
+		if err := appendFile(systemKprobesFile, fmt.Sprintf("-:%s", name)); err != nil {
+			return fmt.Errorf("Error while removing stale probe %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+//
+func staleProbeName(line string, prefix string) string {
+	groupOffset := strings.IndexRune(line, '/')
+	if groupOffset == -1 {
+		return ""
+	}
+
+	rest := line[groupOffset+1:]
+	name, offset := parseNext(rest, ' ')
+	if offset == -1 {
+		name = rest
+	}
+
+	name = strings.TrimSpace(name)
+	if name != "" && strings.HasPrefix(name, prefix) {
+		return name
+	}
+	return ""
+}